@@ -0,0 +1,153 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fsfuse
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ReadLinkFS is implemented by fs.FS values that carry symlinks, matching
+// the shape proposed for a future io/fs.ReadLinkFS (golang.org/issue/49580).
+// Without it, *FS has no way to tell a FUSE client what a symlink points
+// to, so ReadSymlink reports fuse.ENOSYS.
+type ReadLinkFS interface {
+	fs.FS
+
+	// ReadLink returns the destination of the named symlink.
+	ReadLink(name string) (string, error)
+}
+
+// XattrFS is implemented by fs.FS values that carry extended attributes.
+// Without it, GetXattr and ListXattr report fuse.ENOSYS.
+type XattrFS interface {
+	fs.FS
+
+	// Xattr returns all extended attributes of the named file.
+	Xattr(name string) (map[string][]byte, error)
+}
+
+// Statfs holds the capacity/availability numbers reported by StatFS.
+type Statfs struct {
+	BlockSize       uint32
+	IoSize          uint32
+	Blocks          uint64
+	BlocksFree      uint64
+	BlocksAvailable uint64
+	Inodes          uint64
+	InodesFree      uint64
+}
+
+// StatfsFS is implemented by fs.FS values that can report filesystem-level
+// capacity, e.g. for an archive or image whose uncompressed size is known.
+type StatfsFS interface {
+	fs.FS
+
+	StatFS() (Statfs, error)
+}
+
+// defaultStatfs is used when the underlying fs.FS doesn't implement
+// StatfsFS. macOS refuses to mount a file system that errors out of
+// statfs(2), so *FS answers with conservative, read-only-friendly numbers
+// rather than fuse.ENOSYS.
+var defaultStatfs = Statfs{BlockSize: 4096, IoSize: 4096, Blocks: 1 << 20, Inodes: 1 << 20}
+
+func (f *FS) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	s := defaultStatfs
+	if sf, ok := f.fsys.(StatfsFS); ok {
+		var err error
+		if s, err = sf.StatFS(); err != nil {
+			return err
+		}
+	}
+	op.BlockSize = s.BlockSize
+	op.IoSize = s.IoSize
+	op.Blocks = s.Blocks
+	op.BlocksFree = s.BlocksFree
+	op.BlocksAvailable = s.BlocksAvailable
+	op.Inodes = s.Inodes
+	op.InodesFree = s.InodesFree
+	return nil
+}
+
+func (f *FS) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
+	rl, ok := f.fsys.(ReadLinkFS)
+	if !ok {
+		return fuse.ENOSYS
+	}
+	f.mu.RLock()
+	name := f.inodePaths[op.Inode]
+	f.mu.RUnlock()
+	target, err := rl.ReadLink(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fuse.ENOENT
+		}
+		return err
+	}
+	op.Target = target
+	return nil
+}
+
+func (f *FS) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
+	xattrs, err := f.xattrs(op.Inode)
+	if err != nil {
+		return err
+	}
+	value, ok := xattrs[op.Name]
+	if !ok {
+		return fuse.ENOATTR
+	}
+	op.BytesRead = len(value)
+	if len(op.Dst) >= len(value) {
+		copy(op.Dst, value)
+	} else if len(op.Dst) != 0 {
+		return syscall.ERANGE
+	}
+	return nil
+}
+
+func (f *FS) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
+	xattrs, err := f.xattrs(op.Inode)
+	if err != nil {
+		return err
+	}
+	dst := op.Dst
+	for name := range xattrs {
+		n := len(name) + 1 // NUL-terminated
+		if len(dst) >= n {
+			copy(dst, name)
+			dst[len(name)] = 0
+			dst = dst[n:]
+		} else if len(op.Dst) != 0 {
+			return syscall.ERANGE
+		}
+		op.BytesRead += n
+	}
+	return nil
+}
+
+func (f *FS) xattrs(inode fuseops.InodeID) (map[string][]byte, error) {
+	xf, ok := f.fsys.(XattrFS)
+	if !ok {
+		return nil, fuse.ENOSYS
+	}
+	f.mu.RLock()
+	name := f.inodePaths[inode]
+	f.mu.RUnlock()
+	xattrs, err := xf.Xattr(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fuse.ENOENT
+		}
+		return nil, err
+	}
+	return xattrs, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fsfuse
+
+import (
+	"bytes"
+	"context"
+	"io/fs"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// linkXattrFS is a tiny fs.FS used to exercise the optional ReadLinkFS and
+// XattrFS interfaces; it otherwise behaves like fstest.MapFS.
+type linkXattrFS struct {
+	fstest.MapFS
+	links  map[string]string
+	xattrs map[string]map[string][]byte
+	statfs Statfs
+}
+
+func (l linkXattrFS) ReadLink(name string) (string, error) {
+	if target, ok := l.links[name]; ok {
+		return target, nil
+	}
+	return "", fs.ErrNotExist
+}
+
+func (l linkXattrFS) Xattr(name string) (map[string][]byte, error) {
+	if x, ok := l.xattrs[name]; ok {
+		return x, nil
+	}
+	return nil, nil
+}
+
+func (l linkXattrFS) StatFS() (Statfs, error) { return l.statfs, nil }
+
+func newTestFS(t *testing.T) (*FS, linkXattrFS) {
+	t.Helper()
+	fsys := linkXattrFS{
+		MapFS: fstest.MapFS{
+			"real.txt": &fstest.MapFile{Data: []byte("hi")},
+			"link.txt": &fstest.MapFile{Mode: fs.ModeSymlink},
+		},
+		links:  map[string]string{"link.txt": "real.txt"},
+		xattrs: map[string]map[string][]byte{"real.txt": {"user.tag": []byte("v1")}},
+		statfs: Statfs{BlockSize: 4096, Blocks: 10, BlocksFree: 5, Inodes: 2},
+	}
+	return New(fsys), fsys
+}
+
+func TestReadSymlink(t *testing.T) {
+	f, _ := newTestFS(t)
+	inode := f.getPathInode("link.txt")
+
+	op := &fuseops.ReadSymlinkOp{Inode: inode}
+	if err := f.ReadSymlink(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+	if op.Target != "real.txt" {
+		t.Errorf("Target = %q, want %q", op.Target, "real.txt")
+	}
+}
+
+func TestGetAndListXattr(t *testing.T) {
+	f, _ := newTestFS(t)
+	inode := f.getPathInode("real.txt")
+
+	get := &fuseops.GetXattrOp{Inode: inode, Name: "user.tag", Dst: make([]byte, 16)}
+	if err := f.GetXattr(context.Background(), get); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(get.Dst[:get.BytesRead]); got != "v1" {
+		t.Errorf("GetXattr = %q, want %q", got, "v1")
+	}
+
+	if err := f.GetXattr(context.Background(), &fuseops.GetXattrOp{Inode: inode, Name: "nope", Dst: make([]byte, 16)}); err != fuse.ENOATTR {
+		t.Errorf("GetXattr(missing) = %v, want fuse.ENOATTR", err)
+	}
+
+	small := &fuseops.GetXattrOp{Inode: inode, Name: "user.tag", Dst: make([]byte, 1)}
+	if err := f.GetXattr(context.Background(), small); err != syscall.ERANGE {
+		t.Errorf("GetXattr(too small) = %v, want ERANGE", err)
+	}
+
+	list := &fuseops.ListXattrOp{Inode: inode, Dst: make([]byte, 64)}
+	if err := f.ListXattr(context.Background(), list); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(list.Dst[:list.BytesRead]); got != "user.tag\x00" {
+		t.Errorf("ListXattr = %q, want %q", got, "user.tag\x00")
+	}
+}
+
+func TestStatFS(t *testing.T) {
+	f, fsys := newTestFS(t)
+
+	var op fuseops.StatFSOp
+	if err := f.StatFS(context.Background(), &op); err != nil {
+		t.Fatal(err)
+	}
+	if op.Blocks != fsys.statfs.Blocks || op.BlockSize != fsys.statfs.BlockSize {
+		t.Errorf("StatFS = %+v, want %+v", op, fsys.statfs)
+	}
+}
+
+func TestReadDirSymlinkType(t *testing.T) {
+	f, _ := newTestFS(t)
+	root := f.getPathInode(".")
+
+	op := &fuseops.ReadDirOp{Inode: root, Dst: make([]byte, 4096)}
+	if err := f.ReadDir(context.Background(), op); err != nil {
+		t.Fatal(err)
+	}
+	if op.BytesRead == 0 {
+		t.Fatal("ReadDir produced no entries")
+	}
+
+	// The MapFS lists "link.txt" before "real.txt", so the first dirent is
+	// the symlink and must carry DT_Link.
+	want := make([]byte, 64)
+	n := fuseutil.WriteDirent(want, fuseutil.Dirent{
+		Offset: 1,
+		Inode:  f.getPathInode("link.txt"),
+		Name:   "link.txt",
+		Type:   fuseutil.DT_Link,
+	})
+	if !bytes.Equal(op.Dst[:n], want[:n]) {
+		t.Errorf("first dirent = %v, want link.txt with DT_Link (%v)", op.Dst[:n], want[:n])
+	}
+}
@@ -308,6 +308,8 @@ func (f *FS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
 				typ = fuseutil.DT_Block
 			} else if t&fs.ModeNamedPipe != 0 {
 				typ = fuseutil.DT_FIFO
+			} else if t&fs.ModeSymlink != 0 {
+				typ = fuseutil.DT_Link
 			}
 		}
 		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
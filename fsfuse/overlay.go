@@ -0,0 +1,284 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fsfuse
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+)
+
+// whiteoutPrefix marks a deleted entry: a file named whiteoutPrefix+NAME in
+// an upper layer hides NAME in every layer below it.
+const whiteoutPrefix = ".wh."
+
+// opaqueMarker, present in a directory, hides every entry of that directory
+// coming from layers below the one carrying the marker; the directory's own
+// entries in that layer (and any layer above it) are unaffected.
+const opaqueMarker = ".wh..wh..opq"
+
+// Overlay returns an fs.FS that presents layers as a single, merged,
+// read-only tree: layers[0] is the topmost (upper) layer, consulted first;
+// later layers are only consulted for names the layers above don't have an
+// opinion about.
+//
+// Layers follow the whiteout convention used by container image layers
+// (e.g. OverlayFS, Docker/OCI layer diffs):
+//
+//   - a regular file named ".wh.NAME" in a layer deletes NAME from every
+//     layer below it;
+//   - a file named ".wh..wh..opq" inside a directory marks that directory
+//     opaque: entries of the same directory from layers below are not
+//     merged in, only the opaque layer's own entries (and any layer above
+//     it) are.
+//
+// Whiteout and opaque marker files themselves never appear in the merged
+// view.
+func Overlay(layers ...fs.FS) fs.FS {
+	return overlayFS{layers: layers}
+}
+
+type overlayFS struct{ layers []fs.FS }
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	dis, ok, err := o.readDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return &overlayDir{name: name, entries: dis}, nil
+	}
+
+	i, err := o.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return o.layers[i].Open(name)
+}
+
+// visibleLayers returns the prefix of o.layers eligible to be consulted for
+// name itself, honouring a whiteout or opacity anywhere along name's
+// ancestor chain, not just on name's own parent. This is what makes a
+// whited-out or opaqued-away path invisible whether it's reached by Open, by
+// fs.Stat, or by listing one of its ancestor directories.
+func (o overlayFS) visibleLayers(name string) []fs.FS {
+	if name == "." {
+		return o.layers
+	}
+	layers := o.visibleLayers(path.Dir(name))
+	dir := path.Dir(name)
+	base := path.Base(name)
+	for i, layer := range layers {
+		if isWhitedOut(layer, dir, base) {
+			return layers[:i]
+		}
+		if isOpaqueBelow(layer, name) {
+			return layers[:i+1]
+		}
+	}
+	return layers
+}
+
+// topEntry returns the index, within name's visibleLayers, of the topmost
+// layer carrying any entry for name at all, along with whether that entry is
+// a directory. Exactly like a whiteout, that topmost entry's type wins
+// outright: a file shadows a same-named directory in a lower layer just as
+// completely as a directory shadows a same-named file, so resolve and
+// readDir must not independently fall through to whichever lower layer
+// happens to answer.
+func (o overlayFS) topEntry(name string) (layers []fs.FS, idx int, isDir bool, err error) {
+	layers = o.visibleLayers(name)
+	if b := path.Base(name); len(b) > len(whiteoutPrefix) && b[:len(whiteoutPrefix)] == whiteoutPrefix {
+		// whiteout and opaque marker files are never part of the merged view
+		return layers, 0, false, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	for i, layer := range layers {
+		fi, statErr := fs.Stat(layer, name)
+		if statErr == nil {
+			return layers, i, fi.IsDir(), nil
+		}
+		if !isNotExist(statErr) {
+			return layers, 0, false, statErr
+		}
+	}
+	return layers, 0, false, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+// resolve returns the index of the topmost layer that has name, honouring
+// whiteouts and directory opacity along the way.
+func (o overlayFS) resolve(name string) (int, error) {
+	_, idx, _, err := o.topEntry(name)
+	if err != nil {
+		return 0, err
+	}
+	return idx, nil
+}
+
+// readDir reports whether name is a directory in the merged view and, if
+// so, its unioned, whiteout-filtered entries. It merges only from the
+// topmost layer that has any entry for name down: if that topmost entry is
+// a regular file, name is not a directory here at all, regardless of what
+// lower layers hold at the same path.
+func (o overlayFS) readDir(name string) ([]fs.DirEntry, bool, error) {
+	layers, idx, isDir, err := o.topEntry(name)
+	if err != nil {
+		if isNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if !isDir {
+		return nil, false, nil
+	}
+
+	byName := make(map[string]fs.DirEntry)
+	hidden := make(map[string]bool)
+	for _, layer := range layers[idx:] {
+		dis, err := fs.ReadDir(layer, name)
+		if err != nil {
+			continue
+		}
+		opaque := false
+		for _, di := range dis {
+			n := di.Name()
+			switch {
+			case n == opaqueMarker:
+				opaque = true
+			case len(n) > len(whiteoutPrefix) && n[:len(whiteoutPrefix)] == whiteoutPrefix:
+				hidden[n[len(whiteoutPrefix):]] = true
+			case hidden[n]:
+				// shadowed by a whiteout seen in a higher layer
+			default:
+				if _, ok := byName[n]; !ok {
+					byName[n] = di
+				}
+			}
+		}
+		if opaque {
+			break
+		}
+	}
+	names := make([]string, 0, len(byName))
+	for n := range byName {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	out := make([]fs.DirEntry, len(names))
+	for i, n := range names {
+		out[i] = byName[n]
+	}
+	return out, true, nil
+}
+
+func isWhitedOut(layer fs.FS, dir, base string) bool {
+	if base == "." {
+		return false
+	}
+	_, err := fs.Stat(layer, path.Join(dir, whiteoutPrefix+base))
+	return err == nil
+}
+
+// isOpaqueBelow reports whether some ancestor of name (inclusive of name's
+// parent) is marked opaque in layer, which stops the search in layers below it.
+func isOpaqueBelow(layer fs.FS, name string) bool {
+	for dir := path.Dir(name); ; dir = path.Dir(dir) {
+		if _, err := fs.Stat(layer, path.Join(dir, opaqueMarker)); err == nil {
+			return true
+		}
+		if dir == "." {
+			return false
+		}
+	}
+}
+
+// ReadLink implements ReadLinkFS by forwarding to the layer that resolve
+// picks for name.
+func (o overlayFS) ReadLink(name string) (string, error) {
+	i, err := o.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	rl, ok := o.layers[i].(ReadLinkFS)
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return rl.ReadLink(name)
+}
+
+// Xattr implements XattrFS by forwarding to the layer that resolve picks for
+// name; a winning layer that doesn't implement XattrFS is treated as having
+// no extended attributes rather than as an error.
+func (o overlayFS) Xattr(name string) (map[string][]byte, error) {
+	i, err := o.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	xf, ok := o.layers[i].(XattrFS)
+	if !ok {
+		return nil, nil
+	}
+	return xf.Xattr(name)
+}
+
+// StatFS implements StatfsFS by forwarding to the topmost layer that
+// implements it, falling back to defaultStatfs if none does.
+func (o overlayFS) StatFS() (Statfs, error) {
+	for _, layer := range o.layers {
+		if sf, ok := layer.(StatfsFS); ok {
+			return sf.StatFS()
+		}
+	}
+	return defaultStatfs, nil
+}
+
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// overlayDir is the fs.ReadDirFile returned for directories of an overlayFS.
+type overlayDir struct {
+	name    string
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *overlayDir) Stat() (fs.FileInfo, error) {
+	return overlayDirInfo{name: path.Base(d.name)}, nil
+}
+
+func (d *overlayDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *overlayDir) Close() error { return nil }
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	return rest, nil
+}
+
+// overlayDirInfo is a minimal fs.FileInfo for a merged directory; overlaid
+// directories have no single underlying file to report size/mtime from.
+type overlayDirInfo struct{ name string }
+
+func (fi overlayDirInfo) Name() string       { return fi.name }
+func (fi overlayDirInfo) Size() int64        { return 0 }
+func (fi overlayDirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o555 }
+func (fi overlayDirInfo) ModTime() time.Time { return time.Time{} }
+func (fi overlayDirInfo) IsDir() bool        { return true }
+func (fi overlayDirInfo) Sys() any           { return nil }
@@ -0,0 +1,247 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package fsfuse
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// wrappedNotExistFS wraps another fs.FS's not-exist errors in a form that
+// isn't a *fs.PathError, to exercise resolve's fallthrough via errors.Is
+// rather than a hand-rolled unwrap.
+type wrappedNotExistFS struct{ fs.FS }
+
+func (w wrappedNotExistFS) Open(name string) (fs.File, error) {
+	f, err := w.FS.Open(name)
+	if err != nil && errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("wrapped: %w", err)
+	}
+	return f, err
+}
+
+func TestOverlayFallsThroughWrappedNotExistError(t *testing.T) {
+	upper := wrappedNotExistFS{fstest.MapFS{
+		"other": &fstest.MapFile{Data: []byte("x")},
+	}}
+	lower := fstest.MapFS{
+		"foo": &fstest.MapFile{Data: []byte("from-lower")},
+	}
+	fsys := Overlay(upper, lower)
+
+	data, err := fs.ReadFile(fsys, "foo")
+	if err != nil {
+		t.Fatalf("ReadFile(foo) = %v, want fallthrough to lower layer", err)
+	}
+	if string(data) != "from-lower" {
+		t.Errorf("ReadFile(foo) = %q, want %q", data, "from-lower")
+	}
+}
+
+// overlayLinkXattrFS wraps fstest.MapFS with the optional ReadLinkFS,
+// XattrFS and StatfsFS interfaces, to exercise overlayFS's forwarding of
+// them to the layer it resolves a name to.
+type overlayLinkXattrFS struct {
+	fstest.MapFS
+	links  map[string]string
+	xattrs map[string]map[string][]byte
+	statfs Statfs
+}
+
+func (l overlayLinkXattrFS) ReadLink(name string) (string, error) {
+	if target, ok := l.links[name]; ok {
+		return target, nil
+	}
+	return "", fs.ErrNotExist
+}
+
+func (l overlayLinkXattrFS) Xattr(name string) (map[string][]byte, error) {
+	return l.xattrs[name], nil
+}
+
+func (l overlayLinkXattrFS) StatFS() (Statfs, error) { return l.statfs, nil }
+
+func TestOverlayForwardsReadLinkXattrStatfs(t *testing.T) {
+	lower := overlayLinkXattrFS{
+		MapFS: fstest.MapFS{
+			"link.txt": &fstest.MapFile{Mode: fs.ModeSymlink},
+			"real.txt": &fstest.MapFile{Data: []byte("hi")},
+		},
+		links:  map[string]string{"link.txt": "real.txt"},
+		xattrs: map[string]map[string][]byte{"real.txt": {"user.tag": []byte("v1")}},
+		statfs: Statfs{BlockSize: 4096, Blocks: 7},
+	}
+	upper := fstest.MapFS{"extra": &fstest.MapFile{Data: []byte("extra")}}
+	fsys := Overlay(upper, lower)
+
+	rl, ok := fsys.(ReadLinkFS)
+	if !ok {
+		t.Fatal("Overlay(...) does not implement ReadLinkFS")
+	}
+	if target, err := rl.ReadLink("link.txt"); err != nil || target != "real.txt" {
+		t.Errorf("ReadLink(link.txt) = (%q, %v), want (%q, nil)", target, err, "real.txt")
+	}
+
+	xf, ok := fsys.(XattrFS)
+	if !ok {
+		t.Fatal("Overlay(...) does not implement XattrFS")
+	}
+	if x, err := xf.Xattr("real.txt"); err != nil || string(x["user.tag"]) != "v1" {
+		t.Errorf("Xattr(real.txt) = (%v, %v), want user.tag=v1", x, err)
+	}
+
+	sf, ok := fsys.(StatfsFS)
+	if !ok {
+		t.Fatal("Overlay(...) does not implement StatfsFS")
+	}
+	if s, err := sf.StatFS(); err != nil || s.Blocks != 7 {
+		t.Errorf("StatFS() = (%+v, %v), want Blocks=7", s, err)
+	}
+}
+
+func TestOverlayFileShadowing(t *testing.T) {
+	lower := fstest.MapFS{
+		"etc/app.conf": &fstest.MapFile{Data: []byte("lower")},
+		"etc/other":    &fstest.MapFile{Data: []byte("only-lower")},
+	}
+	upper := fstest.MapFS{
+		"etc/app.conf": &fstest.MapFile{Data: []byte("upper")},
+	}
+	fsys := Overlay(upper, lower)
+
+	data, err := fs.ReadFile(fsys, "etc/app.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "upper" {
+		t.Errorf("etc/app.conf = %q, want %q (upper layer should win)", data, "upper")
+	}
+
+	data, err = fs.ReadFile(fsys, "etc/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "only-lower" {
+		t.Errorf("etc/other = %q, want %q", data, "only-lower")
+	}
+}
+
+func TestOverlayDeletedEntry(t *testing.T) {
+	lower := fstest.MapFS{
+		"bin/tool": &fstest.MapFile{Data: []byte("old")},
+	}
+	upper := fstest.MapFS{
+		"bin/.wh.tool": &fstest.MapFile{},
+	}
+	fsys := Overlay(upper, lower)
+
+	if _, err := fsys.Open("bin/tool"); !isNotExist(err) {
+		t.Errorf("Open(bin/tool) = %v, want fs.ErrNotExist", err)
+	}
+
+	dis, err := fs.ReadDir(fsys, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dis) != 0 {
+		t.Errorf("ReadDir(bin) = %v, want empty (whiteout marker hidden too)", dis)
+	}
+}
+
+func TestOverlayWhitedOutDirectoryDirectAccess(t *testing.T) {
+	lower := fstest.MapFS{
+		"etc/app.conf": &fstest.MapFile{Data: []byte("lower")},
+	}
+	upper := fstest.MapFS{
+		".wh.etc": &fstest.MapFile{},
+	}
+	fsys := Overlay(upper, lower)
+
+	// The whiteout hides "etc" itself, not just its entries as seen from a
+	// parent listing: both a direct Open/Stat and a ReadDir must agree.
+	if _, err := fsys.Open("etc"); !isNotExist(err) {
+		t.Errorf("Open(etc) = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := fs.Stat(fsys, "etc"); !isNotExist(err) {
+		t.Errorf("Stat(etc) = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := fs.ReadDir(fsys, "etc"); !isNotExist(err) {
+		t.Errorf("ReadDir(etc) = %v, want fs.ErrNotExist", err)
+	}
+	if _, err := fsys.Open("etc/app.conf"); !isNotExist(err) {
+		t.Errorf("Open(etc/app.conf) = %v, want fs.ErrNotExist (parent whited out)", err)
+	}
+}
+
+func TestOverlayFileShadowsLowerDirectory(t *testing.T) {
+	upper := fstest.MapFS{
+		"foo": &fstest.MapFile{Data: []byte("i-am-a-file")},
+	}
+	lower := fstest.MapFS{
+		"foo/bar": &fstest.MapFile{Data: []byte("should-be-unreachable")},
+	}
+	fsys := Overlay(upper, lower)
+
+	fi, err := fs.Stat(fsys, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.IsDir() {
+		t.Error("Stat(foo).IsDir() = true, want false (upper file shadows lower directory)")
+	}
+
+	if _, err := fs.ReadDir(fsys, "foo"); err == nil {
+		t.Error("ReadDir(foo) succeeded, want error (foo is a file in the topmost layer)")
+	}
+
+	data, err := fs.ReadFile(fsys, "foo")
+	if err != nil {
+		t.Fatalf("ReadFile(foo) = %v, want the upper file's content", err)
+	}
+	if string(data) != "i-am-a-file" {
+		t.Errorf("ReadFile(foo) = %q, want %q", data, "i-am-a-file")
+	}
+}
+
+func TestOverlayDirectoryOpacity(t *testing.T) {
+	base := fstest.MapFS{
+		"data/old1": &fstest.MapFile{Data: []byte("1")},
+		"data/old2": &fstest.MapFile{Data: []byte("2")},
+	}
+	middle := fstest.MapFS{
+		"data/.wh..wh..opq": &fstest.MapFile{},
+		"data/new":          &fstest.MapFile{Data: []byte("new")},
+	}
+	top := fstest.MapFS{
+		"data/extra": &fstest.MapFile{Data: []byte("extra")},
+	}
+	// layers top-down: top, middle (opaque "data"), base
+	fsys := Overlay(top, middle, base)
+
+	dis, err := fs.ReadDir(fsys, "data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, di := range dis {
+		names = append(names, di.Name())
+	}
+	want := map[string]bool{"extra": true, "new": true}
+	if len(names) != len(want) {
+		t.Fatalf("ReadDir(data) = %v, want entries %v (base's old1/old2 must be hidden by opacity)", names, want)
+	}
+	for _, n := range names {
+		if !want[n] {
+			t.Errorf("unexpected entry %q in opaque-shadowed directory", n)
+		}
+	}
+
+	if _, err := fsys.Open("data/old1"); !isNotExist(err) {
+		t.Errorf("Open(data/old1) = %v, want fs.ErrNotExist (shadowed by opaque dir above it)", err)
+	}
+}
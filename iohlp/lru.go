@@ -0,0 +1,69 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package iohlp
+
+import "container/list"
+
+// byteLRU is a small, fixed-capacity LRU cache of byte slices keyed by int64,
+// used to avoid re-inflating the same gzip member on repeated reads.
+//
+// It is safe for concurrent use.
+type byteLRU struct {
+	cap int
+
+	mu    chan struct{} // 1-buffered, used as a mutex
+	ll    *list.List
+	items map[int64]*list.Element
+}
+
+type byteLRUEntry struct {
+	key  int64
+	data []byte
+}
+
+// newByteLRU returns a byteLRU that holds at most n entries.
+// n<=0 is treated as 1.
+func newByteLRU(n int) *byteLRU {
+	if n <= 0 {
+		n = 1
+	}
+	c := &byteLRU{
+		cap:   n,
+		mu:    make(chan struct{}, 1),
+		ll:    list.New(),
+		items: make(map[int64]*list.Element, n),
+	}
+	c.mu <- struct{}{}
+	return c
+}
+
+func (c *byteLRU) Get(key int64) ([]byte, bool) {
+	<-c.mu
+	defer func() { c.mu <- struct{}{} }()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*byteLRUEntry).data, true
+	}
+	return nil, false
+}
+
+func (c *byteLRU) Add(key int64, data []byte) {
+	<-c.mu
+	defer func() { c.mu <- struct{}{} }()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*byteLRUEntry).data = data
+		return
+	}
+	c.items[key] = c.ll.PushFront(&byteLRUEntry{key: key, data: data})
+	for c.ll.Len() > c.cap {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*byteLRUEntry).key)
+	}
+}
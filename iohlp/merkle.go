@@ -0,0 +1,141 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package iohlp
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+// MerkleLeafSize is the chunk size hashed for each Merkle leaf.
+const MerkleLeafSize = 4096
+
+// MerkleFanout is the number of children hashed together to produce each
+// parent node.
+const MerkleFanout = 128
+
+// BuildMerkleRoot hashes r in MerkleLeafSize chunks and folds the resulting
+// leaves, MerkleFanout at a time, into a Merkle tree rooted at the returned
+// hash. The second return value is the whole tree (every level,
+// concatenated, leaves first), serialized as it is needed by MmapVerified;
+// callers should store it alongside the original content.
+func BuildMerkleRoot(r io.Reader) ([32]byte, []byte, error) {
+	var root [32]byte
+	leaves, err := hashLeaves(r)
+	if err != nil {
+		return root, nil, err
+	}
+	tree := append([]byte(nil), leaves...)
+	cur := leaves
+	for len(cur) > 32 {
+		next := foldLevel(cur)
+		tree = append(tree, next...)
+		cur = next
+	}
+	copy(root[:], cur)
+	return root, tree, nil
+}
+
+func hashLeaves(r io.Reader) ([]byte, error) {
+	var leaves []byte
+	buf := make([]byte, MerkleLeafSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			leaves = append(leaves, sum[:]...)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(leaves) == 0 {
+		sum := sha256.Sum256(nil)
+		leaves = sum[:]
+	}
+	return leaves, nil
+}
+
+// foldLevel hashes cur (a level of MerkleFanout-aligned, concatenated
+// 32-byte hashes) into its parent level.
+func foldLevel(cur []byte) []byte {
+	count := len(cur) / sha256.Size
+	next := make([]byte, 0, ((count+MerkleFanout-1)/MerkleFanout)*sha256.Size)
+	for i := 0; i < count; i += MerkleFanout {
+		end := i + MerkleFanout
+		if end > count {
+			end = count
+		}
+		sum := sha256.Sum256(cur[i*sha256.Size : end*sha256.Size])
+		next = append(next, sum[:]...)
+	}
+	return next
+}
+
+// merkleLayout describes the byte offset and node count of every level of
+// a serialized Merkle tree (as produced by BuildMerkleRoot) for a file of
+// leafCount leaves, computed arithmetically so the tree blob itself needs
+// no header.
+type merkleLayout struct {
+	offset []int // byte offset into the tree blob of each level, leaves first
+	count  []int // number of nodes in each level
+}
+
+func leafCountForSize(size int64) int {
+	if size <= 0 {
+		return 1
+	}
+	return int((size + MerkleLeafSize - 1) / MerkleLeafSize)
+}
+
+func computeMerkleLayout(leafCount int) merkleLayout {
+	var l merkleLayout
+	off := 0
+	n := leafCount
+	for {
+		l.offset = append(l.offset, off)
+		l.count = append(l.count, n)
+		off += n * sha256.Size
+		if n == 1 {
+			break
+		}
+		n = (n + MerkleFanout - 1) / MerkleFanout
+	}
+	return l
+}
+
+func (l merkleLayout) treeSize() int {
+	last := len(l.offset) - 1
+	return l.offset[last] + l.count[last]*sha256.Size
+}
+
+func (l merkleLayout) nodeBytes(level, index int) (start, end int) {
+	start = l.offset[level] + index*sha256.Size
+	return start, start + sha256.Size
+}
+
+// childRangeBytes returns the byte range within level (the children level)
+// covered by the index-th node of level+1.
+func (l merkleLayout) childRangeBytes(level, index int) (start, end int) {
+	start = l.offset[level] + index*MerkleFanout*sha256.Size
+	childEnd := (index + 1) * MerkleFanout
+	if childEnd > l.count[level] {
+		childEnd = l.count[level]
+	}
+	end = l.offset[level] + childEnd*sha256.Size
+	return start, end
+}
+
+func validateMerkleTree(tree []byte, leafCount int) (merkleLayout, error) {
+	l := computeMerkleLayout(leafCount)
+	if want := l.treeSize(); len(tree) != want {
+		return l, fmt.Errorf("iohlp: merkle tree is %d bytes, want %d for %d leaves", len(tree), want, leafCount)
+	}
+	return l, nil
+}
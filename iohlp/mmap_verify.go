@@ -0,0 +1,184 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package iohlp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// MmapVerified mmaps f and returns a VerifiedMmap that checks each page
+// against tree (the serialized Merkle tree BuildMerkleRoot produced for f's
+// content, rooted at expected) the first time that page is touched through
+// Verify or ReadAt, instead of hashing the whole file up front.
+//
+// Go has no portable way to hook a SIGBUS on first fault of an mmap'd,
+// otherwise-untouched page, so verification here is driven by explicit
+// Verify/ReadAt calls rather than a page-fault handler; per-node flags still
+// ensures each page, and each tree node above it, is only ever hashed
+// once.
+func MmapVerified(f *os.File, expected [32]byte, tree []byte) (*VerifiedMmap, func(), error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := fi.Size()
+	layout, err := validateMerkleTree(tree, leafCountForSize(size))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, unmap, err := Mmap(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &VerifiedMmap{
+		data:     data,
+		root:     expected,
+		size:     size,
+		tree:     tree,
+		layout:   layout,
+		verified: make([]bool, totalNodes(layout)),
+	}, unmap, nil
+}
+
+// VerifiedMmap is a content-addressed view over an mmap'd file: bytes
+// returned by Verify or ReadAt are guaranteed to match the Merkle tree
+// rooted at the hash it was constructed with; Bytes returns the raw,
+// unchecked mapping for callers that have already verified what they need.
+//
+// A *VerifiedMmap is safe for concurrent use.
+type VerifiedMmap struct {
+	data []byte
+	root [32]byte
+	size int64
+
+	mu       sync.Mutex
+	tree     []byte
+	layout   merkleLayout
+	verified []bool // one flag per tree node, leaves first, flattened across levels
+}
+
+func totalNodes(l merkleLayout) int {
+	n := 0
+	for _, c := range l.count {
+		n += c
+	}
+	return n
+}
+
+// nodeVerifiedIndex returns the flattened index into v.verified for the
+// given (level, index) pair.
+func (v *VerifiedMmap) nodeVerifiedIndex(level, index int) int {
+	n := 0
+	for _, c := range v.layout.count[:level] {
+		n += c
+	}
+	return n + index
+}
+
+// Bytes returns the raw mmap'd content, without verification.
+func (v *VerifiedMmap) Bytes() []byte { return v.data }
+
+// Verify checks every 4 KiB page overlapping [offset, offset+length)
+// against the Merkle tree, hashing each touched page (and, at most once
+// each, the tree nodes above it) only on its first verification.
+func (v *VerifiedMmap) Verify(offset, length int64) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if offset < 0 || length < 0 || offset+length > v.size {
+		return fmt.Errorf("iohlp: range [%d,%d) out of bounds for %d-byte file", offset, offset+length, v.size)
+	}
+	if length == 0 {
+		return nil
+	}
+	firstLeaf := int(offset / MerkleLeafSize)
+	lastLeaf := int((offset + length - 1) / MerkleLeafSize)
+	for leaf := firstLeaf; leaf <= lastLeaf; leaf++ {
+		if err := v.verifyLeaf(leaf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *VerifiedMmap) verifyLeaf(leaf int) error {
+	vi := v.nodeVerifiedIndex(0, leaf)
+	if v.verified[vi] {
+		return nil
+	}
+	start := int64(leaf) * MerkleLeafSize
+	end := start + MerkleLeafSize
+	if end > v.size {
+		end = v.size
+	}
+	got := sha256.Sum256(v.data[start:end])
+	ns, ne := v.layout.nodeBytes(0, leaf)
+	if subtle.ConstantTimeCompare(got[:], v.tree[ns:ne]) != 1 {
+		return fmt.Errorf("iohlp: page %d (bytes [%d,%d)) failed Merkle verification", leaf, start, end)
+	}
+	if err := v.verifyAncestors(0, leaf); err != nil {
+		return err
+	}
+	v.verified[vi] = true
+	return nil
+}
+
+// verifyAncestors checks, bottom-up, that the parent of (level, index)
+// correctly hashes its children, stopping as soon as it reaches a node
+// already marked verified (whose own ancestors were therefore already
+// checked) or the root.
+func (v *VerifiedMmap) verifyAncestors(level, index int) error {
+	if level == len(v.layout.count)-1 {
+		var got [32]byte
+		copy(got[:], v.tree[v.layout.offset[level]:v.layout.offset[level]+sha256.Size])
+		if subtle.ConstantTimeCompare(got[:], v.root[:]) != 1 {
+			return fmt.Errorf("iohlp: Merkle root mismatch")
+		}
+		return nil
+	}
+	parent := index / MerkleFanout
+	pvi := v.nodeVerifiedIndex(level+1, parent)
+	if v.verified[pvi] {
+		return nil
+	}
+	cs, ce := v.layout.childRangeBytes(level, parent)
+	got := sha256.Sum256(v.tree[cs:ce])
+	ns, ne := v.layout.nodeBytes(level+1, parent)
+	if subtle.ConstantTimeCompare(got[:], v.tree[ns:ne]) != 1 {
+		return fmt.Errorf("iohlp: Merkle tree node (level %d, index %d) failed verification", level+1, parent)
+	}
+	if err := v.verifyAncestors(level+1, parent); err != nil {
+		return err
+	}
+	v.verified[pvi] = true
+	return nil
+}
+
+// ReadAt verifies the pages covering [off, off+len(p)) and then copies them
+// into p, like io.ReaderAt.
+func (v *VerifiedMmap) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("iohlp: offset %d out of bounds for %d-byte file", off, v.size)
+	}
+	if off >= v.size {
+		return 0, io.EOF
+	}
+	n := len(p)
+	if rest := v.size - off; int64(n) > rest {
+		n = int(rest)
+	}
+	if err := v.Verify(off, int64(n)); err != nil {
+		return 0, err
+	}
+	n = copy(p, v.data[off:off+int64(n)])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package iohlp
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, size int) (*os.File, []byte) {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	f, err := os.CreateTemp(t.TempDir(), "iohlp-merkle-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f, data
+}
+
+func TestMmapVerified(t *testing.T) {
+	const size = MerkleLeafSize*MerkleFanout + 3*MerkleLeafSize + 17
+	f, data := writeTestFile(t, size)
+
+	root, tree, err := BuildMerkleRoot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm, unmap, err := MmapVerified(f, root, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmap()
+
+	p := make([]byte, 10)
+	if _, err := vm.ReadAt(p, MerkleLeafSize+5); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[MerkleLeafSize+5:MerkleLeafSize+15]) {
+		t.Errorf("ReadAt mismatch")
+	}
+
+	// crossing a fan-out boundary exercises multi-level ancestor checks.
+	if err := vm.Verify(0, int64(size)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMmapVerifiedTamperedPage(t *testing.T) {
+	f, data := writeTestFile(t, 3*MerkleLeafSize)
+	root, tree, err := BuildMerkleRoot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Tamper with the file on disk after the tree was built over its
+	// original content, as if an attacker modified it later.
+	if _, err := f.WriteAt([]byte{data[MerkleLeafSize+1] ^ 0xff}, MerkleLeafSize+1); err != nil {
+		t.Fatal(err)
+	}
+
+	vm, unmap, err := MmapVerified(f, root, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmap()
+
+	if err := vm.Verify(0, MerkleLeafSize); err != nil {
+		t.Fatalf("untouched page failed: %v", err)
+	}
+	if err := vm.Verify(MerkleLeafSize, MerkleLeafSize); err == nil {
+		t.Fatal("Verify of tampered page succeeded, want error")
+	}
+
+	p := bytes.Repeat([]byte{0xAA}, MerkleLeafSize)
+	if _, err := vm.ReadAt(p, MerkleLeafSize); err == nil {
+		t.Fatal("ReadAt of tampered page succeeded, want error")
+	} else if !bytes.Equal(p, bytes.Repeat([]byte{0xAA}, MerkleLeafSize)) {
+		t.Error("ReadAt wrote unverified data into the caller's buffer before failing")
+	}
+
+	if _, err := vm.ReadAt(make([]byte, 1), -1); err == nil {
+		t.Fatal("ReadAt(-1) succeeded, want error")
+	}
+}
+
+func TestMmapVerifiedWrongRoot(t *testing.T) {
+	f, data := writeTestFile(t, MerkleLeafSize)
+	_, tree, err := BuildMerkleRoot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wrongRoot [32]byte
+	vm, unmap, err := MmapVerified(f, wrongRoot, tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unmap()
+	if err := vm.Verify(0, MerkleLeafSize); err == nil {
+		t.Fatal("Verify against the wrong root succeeded, want error")
+	}
+}
+
+func TestMmapVerifiedBadTree(t *testing.T) {
+	f, data := writeTestFile(t, MerkleLeafSize)
+	root, _, err := BuildMerkleRoot(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := MmapVerified(f, root, []byte("too short")); err == nil {
+		t.Fatal("MmapVerified with a malformed tree succeeded, want error")
+	}
+}
+
+func BenchmarkMmapVerifiedColdRead(b *testing.B) {
+	const size = 16 * MerkleLeafSize * MerkleFanout
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	f, err := os.CreateTemp(b.TempDir(), "iohlp-merkle-bench-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		b.Fatal(err)
+	}
+	root, tree, err := BuildMerkleRoot(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("MmapFile", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p, unmap, err := MmapFile(f.Name())
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = p[size/2]
+			unmap()
+		}
+	})
+
+	b.Run("MmapVerified", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			vm, unmap, err := MmapVerified(f, root, tree)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := vm.Verify(size/2, 1); err != nil {
+				b.Fatal(err)
+			}
+			unmap()
+		}
+	})
+}
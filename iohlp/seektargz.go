@@ -0,0 +1,392 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package iohlp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// estargzFooterSize is the size of the trailing, uncompressed footer that
+// points at the TOC's gzip member: magic(8) + offset(8) + length(8).
+const estargzFooterSize = 24
+
+var estargzFooterMagic = [8]byte{'S', 'T', 'G', 'Z', 'T', 'O', 'C', '1'}
+
+// tocEntry describes where one archive member lives: Offset and
+// CompressedSize locate its own, independently decompressable gzip member
+// in the underlying ReaderAt, Size is the uncompressed content length.
+type tocEntry struct {
+	Name           string
+	Offset         int64
+	CompressedSize int64
+	Size           int64
+	Mode           fs.FileMode
+	ModTime        time.Time
+	Linkname       string // link target from the tar header; ReadLink reports it only when Mode&fs.ModeSymlink != 0
+}
+
+// OpenSeekableTarGz opens a gzip+tar archive of size bytes in which every
+// member is stored as its own, independently decompressable gzip member
+// (the layout used by stargz-snapshotter's estargz), and returns an fs.FS
+// that can read any file with a single ReadAt on ra plus one gzip member's
+// worth of inflate, instead of scanning the whole archive.
+//
+// If the archive carries a trailing table of contents (a small footer
+// pointing at a gzip member holding the JSON-encoded index), it is used
+// directly. Otherwise the TOC is built by scanning the archive once, on
+// this first Open; later opens of the same fs.FS are cheap.
+//
+// A typical use, mounting the archive read-only over FUSE:
+//
+//	fsys, err := iohlp.OpenSeekableTarGz(ra, size)
+//	...
+//	_, err = fsfuse.Mount(ctx, fsfuse.NewServer(fsys), mnt)
+func OpenSeekableTarGz(ra io.ReaderAt, size int64) (fs.FS, error) {
+	entries, err := readTOCFooter(ra, size)
+	if err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		if entries, err = buildTOC(ra, size); err != nil {
+			return nil, err
+		}
+	}
+	return newSeekableTarGzFS(ra, entries), nil
+}
+
+// readTOCFooter reads the trailing footer, if any, and returns the parsed
+// TOC. A nil, nil return means the archive has no footer and the TOC must
+// be built by scanning.
+func readTOCFooter(ra io.ReaderAt, size int64) ([]tocEntry, error) {
+	if size < estargzFooterSize {
+		return nil, nil
+	}
+	var footer [estargzFooterSize]byte
+	if _, err := ra.ReadAt(footer[:], size-estargzFooterSize); err != nil {
+		return nil, fmt.Errorf("read footer: %w", err)
+	}
+	if !bytes.Equal(footer[:8], estargzFooterMagic[:]) {
+		return nil, nil
+	}
+	tocOffset := int64(binary.BigEndian.Uint64(footer[8:16]))
+	tocLength := int64(binary.BigEndian.Uint64(footer[16:24]))
+	gr, err := gzip.NewReader(io.NewSectionReader(ra, tocOffset, tocLength))
+	if err != nil {
+		return nil, fmt.Errorf("open TOC member: %w", err)
+	}
+	defer gr.Close()
+	var entries []tocEntry
+	if err := json.NewDecoder(gr).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decode TOC: %w", err)
+	}
+	return entries, nil
+}
+
+// buildTOC scans the archive once, member by member, recording each tar
+// entry's offset and length within ra so that later reads can pread
+// straight to it.
+func buildTOC(ra io.ReaderAt, size int64) ([]tocEntry, error) {
+	cr := &countingReader{r: io.NewSectionReader(ra, 0, size)}
+	var entries []tocEntry
+	for cr.n < size {
+		memberStart := cr.n
+		// gzip's flate decoder reads ahead into its own buffer, so a shared
+		// Reader would lose track of exactly where this member ends. Forcing
+		// one byte per Read makes it ask for only what it needs, so cr.n
+		// lands exactly on the next member's first byte once this one is
+		// fully drained.
+		gr, err := gzip.NewReader(&oneByteReader{r: cr})
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("member at %d: %w", memberStart, err)
+		}
+		gr.Multistream(false)
+		tr := tar.NewReader(gr)
+		hdr, err := tr.Next()
+		if err != nil {
+			gr.Close()
+			return nil, fmt.Errorf("member at %d: tar header: %w", memberStart, err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			gr.Close()
+			return nil, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+		if _, err := io.Copy(io.Discard, gr); err != nil && !errors.Is(err, io.EOF) {
+			gr.Close()
+			return nil, fmt.Errorf("%s: drain: %w", hdr.Name, err)
+		}
+		gr.Close()
+		entries = append(entries, tocEntry{
+			Name:           path.Clean(strings.TrimPrefix(hdr.Name, "/")),
+			Offset:         memberStart,
+			CompressedSize: cr.n - memberStart,
+			Size:           hdr.Size,
+			Mode:           hdr.FileInfo().Mode(),
+			ModTime:        hdr.ModTime,
+			Linkname:       hdr.Linkname,
+		})
+	}
+	return entries, nil
+}
+
+// countingReader wraps an io.Reader, tracking how many bytes have been
+// read so buildTOC can recover each gzip member's compressed offset.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// oneByteReader reads at most one byte per call, regardless of how large a
+// buffer the caller offers, so a shared, position-tracking reader below it
+// never gets read past an exact stream boundary by an over-eager reader
+// (such as flate's) sitting above it.
+type oneByteReader struct{ r io.Reader }
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var b [1]byte
+	n, err := o.r.Read(b[:])
+	if n > 0 {
+		p[0] = b[0]
+	}
+	return n, err
+}
+
+type seekableTarGzFS struct {
+	ra      io.ReaderAt
+	entries map[string]*tocEntry
+	dirs    map[string][]string // dir path -> sorted base names of direct children
+	cache   *byteLRU
+}
+
+// DefaultSeekableTarGzCacheSize is the number of inflated members kept
+// around by a seekableTarGzFS's LRU cache.
+const DefaultSeekableTarGzCacheSize = 32
+
+func newSeekableTarGzFS(ra io.ReaderAt, entries []tocEntry) *seekableTarGzFS {
+	fsys := &seekableTarGzFS{
+		ra:      ra,
+		entries: make(map[string]*tocEntry, len(entries)),
+		dirs:    make(map[string][]string),
+		cache:   newByteLRU(DefaultSeekableTarGzCacheSize),
+	}
+	fsys.dirs["."] = nil
+	for i := range entries {
+		e := &entries[i]
+		if e.Name == "." || e.Name == "" {
+			continue
+		}
+		if e.Mode.IsDir() {
+			if _, ok := fsys.dirs[e.Name]; !ok {
+				fsys.dirs[e.Name] = nil
+			}
+		}
+		fsys.entries[e.Name] = e
+		fsys.addChild(e.Name)
+	}
+	for dir, kids := range fsys.dirs {
+		sort.Strings(kids)
+		fsys.dirs[dir] = kids
+	}
+	return fsys
+}
+
+// addChild registers name (and any missing ancestor directories) as a
+// child of its parent directory.
+func (f *seekableTarGzFS) addChild(name string) {
+	for name != "." {
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+		if !contains(f.dirs[dir], base) {
+			f.dirs[dir] = append(f.dirs[dir], base)
+		}
+		if _, ok := f.dirs[dir]; !ok {
+			f.dirs[dir] = nil
+		}
+		name = dir
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *seekableTarGzFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if kids, ok := f.dirs[name]; ok {
+		return &tarGzDir{name: name, kids: kids, fsys: f}, nil
+	}
+	e, ok := f.entries[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &tarGzFile{e: e, fsys: f}, nil
+}
+
+// ReadLink returns the destination of the named symlink, matching the shape
+// expected by fsfuse.ReadLinkFS so a seekableTarGzFS can be mounted with
+// working symlinks without fsfuse importing this package.
+func (f *seekableTarGzFS) ReadLink(name string) (string, error) {
+	e, ok := f.entries[name]
+	if !ok || e.Mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.Linkname, nil
+}
+
+// inflate decompresses the gzip member for e, consulting and filling the
+// shared LRU so repeated sequential reads of the same file don't re-inflate it.
+func (f *seekableTarGzFS) inflate(e *tocEntry) ([]byte, error) {
+	if data, ok := f.cache.Get(e.Offset); ok {
+		return data, nil
+	}
+	compressed := make([]byte, e.CompressedSize)
+	if n, err := f.ra.ReadAt(compressed, e.Offset); n < len(compressed) {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer gr.Close()
+	tr := tar.NewReader(gr)
+	if _, err := tr.Next(); err != nil {
+		return nil, err
+	}
+	data := make([]byte, e.Size)
+	if _, err := io.ReadFull(tr, data); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	f.cache.Add(e.Offset, data)
+	return data, nil
+}
+
+type tocFileInfo struct{ e *tocEntry }
+
+func (fi tocFileInfo) Name() string       { return path.Base(fi.e.Name) }
+func (fi tocFileInfo) Size() int64        { return fi.e.Size }
+func (fi tocFileInfo) Mode() fs.FileMode  { return fi.e.Mode }
+func (fi tocFileInfo) ModTime() time.Time { return fi.e.ModTime }
+func (fi tocFileInfo) IsDir() bool        { return fi.e.Mode.IsDir() }
+func (fi tocFileInfo) Sys() any           { return fi.e }
+
+type tarGzFile struct {
+	e      *tocEntry
+	fsys   *seekableTarGzFS
+	once   sync.Once
+	data   []byte
+	err    error
+	offset int64
+}
+
+func (t *tarGzFile) ensure() error {
+	t.once.Do(func() { t.data, t.err = t.fsys.inflate(t.e) })
+	return t.err
+}
+
+func (t *tarGzFile) Stat() (fs.FileInfo, error) { return tocFileInfo{t.e}, nil }
+
+func (t *tarGzFile) Read(p []byte) (int, error) {
+	if err := t.ensure(); err != nil {
+		return 0, err
+	}
+	if t.offset >= int64(len(t.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, t.data[t.offset:])
+	t.offset += int64(n)
+	return n, nil
+}
+
+// ReadAt lets callers (e.g. fsfuse) pread into the already-inflated member
+// without disturbing the sequential Read offset.
+func (t *tarGzFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := t.ensure(); err != nil {
+		return 0, err
+	}
+	if off >= int64(len(t.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, t.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (t *tarGzFile) Close() error { return nil }
+
+type tarGzDir struct {
+	name   string
+	kids   []string
+	fsys   *seekableTarGzFS
+	offset int
+}
+
+func (d *tarGzDir) Stat() (fs.FileInfo, error) {
+	if e, ok := d.fsys.entries[d.name]; ok {
+		return tocFileInfo{e}, nil
+	}
+	// "." and directories implied only by their children's paths have no entry
+	return tocFileInfo{&tocEntry{Name: d.name, Mode: fs.ModeDir | 0o555}}, nil
+}
+func (d *tarGzDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+func (d *tarGzDir) Close() error { return nil }
+
+func (d *tarGzDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.kids[d.offset:]
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	out := make([]fs.DirEntry, 0, len(rest))
+	for _, base := range rest {
+		child := path.Join(d.name, base)
+		if e, ok := d.fsys.entries[child]; ok {
+			out = append(out, fs.FileInfoToDirEntry(tocFileInfo{e}))
+		} else {
+			out = append(out, fs.FileInfoToDirEntry(tocFileInfo{&tocEntry{Name: child, Mode: fs.ModeDir | 0o555}}))
+		}
+	}
+	d.offset += len(rest)
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	return out, nil
+}
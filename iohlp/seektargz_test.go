@@ -0,0 +1,178 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package iohlp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+// writeSeekableTarGz writes those of a.txt, dir/b.txt and dir/sub/c.txt that
+// are present in files, in that order, each as its own gzip member (other
+// names in files are ignored), optionally followed by a TOC footer,
+// mirroring the layout OpenSeekableTarGz understands.
+func writeSeekableTarGz(t *testing.T, withFooter bool, files map[string][]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var entries []tocEntry
+	for _, name := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"} {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+		start := buf.Len()
+		gw := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gw)
+		hdr := &tar.Header{Name: name, Size: int64(len(data)), Mode: 0o644, ModTime: time.Unix(0, 0)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tocEntry{Name: name, Offset: int64(start), CompressedSize: int64(buf.Len() - start), Size: int64(len(data))})
+	}
+	if withFooter {
+		tocStart := buf.Len()
+		gw := gzip.NewWriter(&buf)
+		if err := json.NewEncoder(gw).Encode(entries); err != nil {
+			t.Fatal(err)
+		}
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var footer [estargzFooterSize]byte
+		copy(footer[:8], estargzFooterMagic[:])
+		binary.BigEndian.PutUint64(footer[8:16], uint64(tocStart))
+		binary.BigEndian.PutUint64(footer[16:24], uint64(buf.Len()-tocStart))
+		buf.Write(footer[:])
+	}
+	return buf.Bytes()
+}
+
+func TestSeekableTarGzReadLink(t *testing.T) {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	hdr := &tar.Header{
+		Name:     "link.txt",
+		Typeflag: tar.TypeSymlink,
+		Linkname: "real.txt",
+		Mode:     0o777,
+		ModTime:  time.Unix(0, 0),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+
+	fsys, err := OpenSeekableTarGz(bytes.NewReader(raw), int64(len(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, ok := fsys.(interface{ ReadLink(string) (string, error) })
+	if !ok {
+		t.Fatal("seekableTarGzFS does not implement ReadLink")
+	}
+	target, err := rl.ReadLink("link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "real.txt" {
+		t.Errorf("ReadLink(link.txt) = %q, want %q", target, "real.txt")
+	}
+
+	fi, err := fs.Stat(fsys, "link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Mode() = %v, want ModeSymlink set", fi.Mode())
+	}
+
+	if _, err := rl.ReadLink("nope"); err == nil {
+		t.Error("ReadLink(nope) succeeded, want error")
+	}
+}
+
+func TestOpenSeekableTarGz(t *testing.T) {
+	files := map[string][]byte{
+		"a.txt":         bytes.Repeat([]byte("hello"), 100),
+		"dir/b.txt":     []byte("world"),
+		"dir/sub/c.txt": []byte("nested"),
+	}
+
+	for _, withFooter := range []bool{true, false} {
+		t.Run(map[bool]string{true: "with-footer", false: "scanned"}[withFooter], func(t *testing.T) {
+			raw := writeSeekableTarGz(t, withFooter, files)
+			fsys, err := OpenSeekableTarGz(bytes.NewReader(raw), int64(len(raw)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, want := range files {
+				got, err := fs.ReadFile(fsys, name)
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s: got %q, want %q", name, got, want)
+				}
+				// second read should hit the LRU, not re-inflate.
+				if got2, err := fs.ReadFile(fsys, name); err != nil || !bytes.Equal(got2, want) {
+					t.Errorf("%s: second read mismatch: %v", name, err)
+				}
+			}
+
+			dis, err := fs.ReadDir(fsys, "dir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, di := range dis {
+				names = append(names, di.Name())
+			}
+			if len(names) != 2 {
+				t.Errorf("dir entries = %v, want 2 entries", names)
+			}
+
+			f, err := fsys.Open("a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			ra, ok := f.(io.ReaderAt)
+			if !ok {
+				t.Fatal("file does not implement io.ReaderAt")
+			}
+			p := make([]byte, 5)
+			if _, err := ra.ReadAt(p, 5); err != nil {
+				t.Fatal(err)
+			}
+			if string(p) != "hello" {
+				t.Errorf("ReadAt(5) = %q, want %q", p, "hello")
+			}
+		})
+	}
+}